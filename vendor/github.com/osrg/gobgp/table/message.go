@@ -12,12 +12,28 @@
 // implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
+//
+// NOTE: this file carries local patches on top of upstream osrg/gobgp
+// (packerMP coalescing, ValidateAsPath, SanitizePathAttributes, PackOptions)
+// that have not been submitted upstream yet. vendor/ is normally regenerated
+// wholesale by `go mod vendor` from go.mod/go.sum, which this checkout
+// doesn't have, so these edits will be silently lost the next time vendoring
+// is regenerated against upstream; they should be sent as a gobgp PR and
+// pulled in through go.mod rather than carried here indefinitely. As of this
+// patch series, no other package in this repository calls
+// table.CreateUpdateMsgFromPaths, table.ValidateAsPath, or
+// table.SanitizePathAttributes, so none of it is on a live code path yet.
 
 package table
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"reflect"
+	"sync/atomic"
 
 	"github.com/osrg/gobgp/packet/bgp"
 	log "github.com/sirupsen/logrus"
@@ -74,6 +90,13 @@ func UpdatePathAttrs2ByteAs(msg *bgp.BGPUpdate) error {
 }
 
 func UpdatePathAttrs4ByteAs(msg *bgp.BGPUpdate) error {
+	// Drop malformed-but-discardable optional transitive attributes before
+	// doing anything else with msg, so a single bad AS4_PATH/AGGREGATOR/etc.
+	// doesn't take the whole UPDATE (and the session) down with it.
+	if _, err := SanitizePathAttributes(msg); err != nil {
+		return err
+	}
+
 	var asAttr *bgp.PathAttributeAsPath
 	var as4Attr *bgp.PathAttributeAs4Path
 	asAttrPos := 0
@@ -203,6 +226,231 @@ func UpdatePathAttrs4ByteAs(msg *bgp.BGPUpdate) error {
 	return nil
 }
 
+var (
+	// ErrAsPathLoop is returned by ValidateAsPath when localAS appears in a
+	// non-CONFED segment of the AS_PATH. BIRD and most other implementations
+	// treat this as a withdrawal rather than a session-resetting error, so it
+	// is returned as a plain sentinel instead of a *bgp.MessageError.
+	ErrAsPathLoop = errors.New("AS_PATH loop: local AS found in path")
+	// ErrReflectionLoop is returned when ORIGINATOR_ID or CLUSTER_LIST shows
+	// the UPDATE was already reflected by us.
+	ErrReflectionLoop = errors.New("route reflection loop: originator or cluster-id matches local")
+)
+
+// asPathValidationErrors counts every UPDATE ValidateAsPath has rejected,
+// whether for being malformed, an AS_PATH loop, or a reflection loop, for
+// callers that want to expose it as a metric.
+var asPathValidationErrors uint64
+
+// AsPathValidationErrorCount returns the number of UPDATEs ValidateAsPath has
+// rejected (malformed AS_PATH, ErrAsPathLoop, or ErrReflectionLoop) since
+// process start.
+func AsPathValidationErrorCount() uint64 {
+	return atomic.LoadUint64(&asPathValidationErrors)
+}
+
+// ValidateOptions carries the session-specific context ValidateAsPath needs
+// that isn't derivable from the UPDATE message itself.
+type ValidateOptions struct {
+	// EBGP marks the session as eBGP; AS_CONFED_SEQUENCE/AS_CONFED_SET
+	// segments are only legal on iBGP sessions (RFC 5065 5.).
+	EBGP bool
+	// RouterID, when set, is compared against ORIGINATOR_ID to catch routes
+	// reflected back to ourselves.
+	RouterID net.IP
+	// ClusterID, when set, is compared against CLUSTER_LIST for the same
+	// reason.
+	ClusterID net.IP
+}
+
+// ValidateAsPath walks the AS_PATH of msg, which must already have been
+// normalized by UpdatePathAttrs4ByteAs, and rejects it per BIRD's
+// validate_path() and RFC 4271 6.3: a zero-length segment, an AS_SET/
+// AS_SEQUENCE segment mixed in after a CONFED segment, a CONFED segment on
+// an eBGP session, or an unknown segment type all return a
+// BGP_ERROR_SUB_MALFORMED_AS_PATH *bgp.MessageError. A localAS loop returns
+// ErrAsPathLoop and an ORIGINATOR_ID/CLUSTER_LIST match against opts returns
+// ErrReflectionLoop; callers are expected to treat both as a withdrawal
+// rather than tearing down the session.
+func ValidateAsPath(msg *bgp.BGPUpdate, localAS uint32, opts ValidateOptions) error {
+	var asAttr *bgp.PathAttributeAsPath
+	for _, attr := range msg.PathAttributes {
+		if a, ok := attr.(*bgp.PathAttributeAsPath); ok {
+			asAttr = a
+			break
+		}
+	}
+
+	if asAttr != nil {
+		inConfed := false
+		for _, param := range asAttr.Value {
+			p, ok := param.(*bgp.As4PathParam)
+			if !ok {
+				atomic.AddUint64(&asPathValidationErrors, 1)
+				return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_AS_PATH, nil, "AS_PATH segment is not 4-byte encoded")
+			}
+
+			if len(p.AS) == 0 {
+				atomic.AddUint64(&asPathValidationErrors, 1)
+				return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_AS_PATH, nil, "AS_PATH segment has zero length")
+			}
+
+			switch p.Type {
+			case bgp.BGP_ASPATH_ATTR_TYPE_SET, bgp.BGP_ASPATH_ATTR_TYPE_SEQ:
+				if inConfed {
+					atomic.AddUint64(&asPathValidationErrors, 1)
+					return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_AS_PATH, nil, "AS_SET/AS_SEQUENCE segment follows an AS_CONFED segment")
+				}
+				for _, as := range p.AS {
+					if as == localAS {
+						atomic.AddUint64(&asPathValidationErrors, 1)
+						return ErrAsPathLoop
+					}
+				}
+			case bgp.BGP_ASPATH_ATTR_TYPE_CONFED_SET, bgp.BGP_ASPATH_ATTR_TYPE_CONFED_SEQ:
+				if opts.EBGP {
+					atomic.AddUint64(&asPathValidationErrors, 1)
+					return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_AS_PATH, nil, "AS_CONFED segment received over an eBGP session")
+				}
+				inConfed = true
+			default:
+				atomic.AddUint64(&asPathValidationErrors, 1)
+				return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_AS_PATH, nil, fmt.Sprintf("unknown AS_PATH segment type %d", p.Type))
+			}
+		}
+	}
+
+	for _, attr := range msg.PathAttributes {
+		switch a := attr.(type) {
+		case *bgp.PathAttributeOriginatorId:
+			if opts.RouterID != nil && a.Value.Equal(opts.RouterID) {
+				atomic.AddUint64(&asPathValidationErrors, 1)
+				return ErrReflectionLoop
+			}
+		case *bgp.PathAttributeClusterList:
+			if opts.ClusterID == nil {
+				continue
+			}
+			for _, id := range a.Value {
+				if id.Equal(opts.ClusterID) {
+					atomic.AddUint64(&asPathValidationErrors, 1)
+					return ErrReflectionLoop
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// mandatoryAttrTypes are well-known mandatory attributes (for IPv4 unicast);
+// SanitizePathAttributes never discards these, no matter how malformed.
+var mandatoryAttrTypes = map[bgp.BGPAttrType]bool{
+	bgp.BGP_ATTR_TYPE_ORIGIN:   true,
+	bgp.BGP_ATTR_TYPE_AS_PATH:  true,
+	bgp.BGP_ATTR_TYPE_NEXT_HOP: true,
+}
+
+// discardableAttrTypes are the optional transitive attributes
+// draft-ietf-idr-optional-transitive allows a speaker to discard, rather
+// than reset the session over, when they turn out to be malformed.
+var discardableAttrTypes = map[bgp.BGPAttrType]bool{
+	bgp.BGP_ATTR_TYPE_AGGREGATOR:           true,
+	bgp.BGP_ATTR_TYPE_AS4_AGGREGATOR:       true,
+	bgp.BGP_ATTR_TYPE_AS4_PATH:             true,
+	bgp.BGP_ATTR_TYPE_COMMUNITIES:          true,
+	bgp.BGP_ATTR_TYPE_EXTENDED_COMMUNITIES: true,
+	bgp.BGP_ATTR_TYPE_LARGE_COMMUNITY:      true,
+	bgp.BGP_ATTR_TYPE_ORIGINATOR_ID:        true,
+	bgp.BGP_ATTR_TYPE_CLUSTER_LIST:         true,
+}
+
+// discardedAttrCount counts attributes SanitizePathAttributes (or the
+// AS4_AGGREGATOR check in UpdatePathAggregator4ByteAs) has dropped, for
+// callers that want to expose it as a metric.
+var discardedAttrCount uint64
+
+// DiscardedAttrCount returns the number of path attributes discarded as
+// malformed-but-optional-transitive since process start.
+func DiscardedAttrCount() uint64 {
+	return atomic.LoadUint64(&discardedAttrCount)
+}
+
+// AttributeDiscardHook, when set, is called every time SanitizePathAttributes
+// or UpdatePathAggregator4ByteAs drops an attribute, so callers can log or
+// meter which attribute types are being discarded. It is one process-wide
+// hook and receives only the attribute type: it is not told which peer the
+// UPDATE came from.
+var AttributeDiscardHook func(t bgp.BGPAttrType)
+
+func notifyAttributeDiscarded(t bgp.BGPAttrType) {
+	atomic.AddUint64(&discardedAttrCount, 1)
+	if AttributeDiscardHook != nil {
+		AttributeDiscardHook(t)
+	}
+}
+
+// badFlags reports whether attr's on-the-wire flags (preserved by
+// bgp.BGPUpdate.DecodeFromBytes on the attribute itself, unlike its length,
+// which isn't kept once decoded) disagree with bgp.PathAttrFlags for its
+// type. A Serialize() round-trip can't catch this: Serialize rebuilds the
+// flags byte from the already-parsed struct, so it always agrees with
+// itself. Two bits are masked out before comparing: BGP_ATTR_FLAG_EXTENDED_LENGTH,
+// since a peer is free to pick either length encoding, and BGP_ATTR_FLAG_PARTIAL,
+// which RFC 4271 4.3 and RFC 7606 4 both say a transiting AS legitimately
+// sets on an optional transitive attribute it doesn't recognize - treating
+// Partial as malformed would discard valid COMMUNITIES/AS4_PATH/AGGREGATOR
+// attributes that simply transited an AS that didn't understand them.
+//
+// Because ParseBGPMessage already validates flags before it will build a
+// typed attribute at all, in practice this only fires on attributes with a
+// flags byte that's wrong in some way other than those two legitimate bits -
+// which, for anything ParseBGPMessage accepted, is attributes that some
+// other in-process code constructed or mutated after decode, not ones a
+// peer sent maliciously on the wire. It's kept as a defense-in-depth check
+// for that case, not as the primary line of defense against wire-malformed
+// flags.
+func badFlags(attr bgp.PathAttributeInterface) bool {
+	want, known := bgp.PathAttrFlags[attr.GetType()]
+	if !known {
+		return false
+	}
+	const ignore = bgp.BGP_ATTR_FLAG_EXTENDED_LENGTH | bgp.BGP_ATTR_FLAG_PARTIAL
+	return attr.GetFlags()&^ignore != want&^ignore
+}
+
+// SanitizePathAttributes is a pre-processing pass, run by UpdatePathAttrs4ByteAs
+// before it does anything else, that discards attributes whose flags are
+// malformed (see badFlags's doc for what that does and doesn't catch)
+// instead of failing the whole UPDATE - see the package-level
+// discardableAttrTypes doc for the rationale. The well-known mandatory
+// attributes (ORIGIN, AS_PATH, NEXT_HOP) and anything else not in
+// discardableAttrTypes still return a session-resetting *bgp.MessageError,
+// same as before this pass existed.
+//
+// This is wired into UpdatePathAttrs4ByteAs, the receive-side normalizer,
+// rather than into CreateUpdateMsgFromPaths/packerInterface.pack: those
+// operate on already-validated *Path values producing outbound messages, so
+// there's no *bgp.BGPUpdate left at that point for a discard pass to run
+// against.
+func SanitizePathAttributes(msg *bgp.BGPUpdate) (discarded []bgp.BGPAttrType, err error) {
+	kept := make([]bgp.PathAttributeInterface, 0, len(msg.PathAttributes))
+	for _, attr := range msg.PathAttributes {
+		t := attr.GetType()
+		if badFlags(attr) {
+			if mandatoryAttrTypes[t] || !discardableAttrTypes[t] {
+				return discarded, bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_ATTRIBUTE_LIST, nil, fmt.Sprintf("malformed flags on %s", t))
+			}
+			discarded = append(discarded, t)
+			notifyAttributeDiscarded(t)
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	msg.PathAttributes = kept
+	return discarded, nil
+}
+
 func UpdatePathAggregator2ByteAs(msg *bgp.BGPUpdate) {
 	as := uint32(0)
 	var addr string
@@ -246,7 +494,11 @@ func UpdatePathAggregator4ByteAs(msg *bgp.BGPUpdate) error {
 	}
 
 	if aggAttr == nil && agg4Attr != nil {
-		return bgp.NewMessageError(bgp.BGP_ERROR_UPDATE_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_MALFORMED_ATTRIBUTE_LIST, nil, "AS4 AGGREGATOR attribute exists, but AGGREGATOR doesn't")
+		// AS4_AGGREGATOR without AGGREGATOR is malformed; see discardableAttrTypes
+		// for why we discard it instead of resetting the session.
+		msg.PathAttributes = append(msg.PathAttributes[:agg4AttrPos], msg.PathAttributes[agg4AttrPos+1:]...)
+		notifyAttributeDiscarded(bgp.BGP_ATTR_TYPE_AS4_AGGREGATOR)
+		return nil
 	}
 
 	if agg4Attr != nil {
@@ -256,6 +508,43 @@ func UpdatePathAggregator4ByteAs(msg *bgp.BGPUpdate) error {
 	return nil
 }
 
+// PackOptions lets a caller of CreateUpdateMsgFromPathsWithOptions override
+// how paths are batched into UPDATE messages, on top of the AddPath-aware
+// coalescing packerV4/packerMP already do by default.
+type PackOptions struct {
+	// MaxMessageLen overrides bgp.BGP_MAX_MESSAGE_LENGTH when non-zero, e.g.
+	// to stay under 4096 bytes for BGP speakers that predate RFC 8654.
+	MaxMessageLen int
+	// MaxUpdatesPerFlush caps how many paths are coalesced into a single
+	// UPDATE regardless of remaining size budget; zero means unlimited.
+	MaxUpdatesPerFlush int
+	// PreferAggregation controls whether paths that share attributes (and,
+	// for MP families, nexthop) are coalesced into one UPDATE at all. A nil
+	// *PackOptions coalesces; a non-nil PackOptions coalesces only when this
+	// is set to true, and with it false (its zero value) every UPDATE carries
+	// one path, which fragments aggressively for latency-sensitive scenarios
+	// where a larger message would delay the first NLRI.
+	PreferAggregation bool
+}
+
+func (o *PackOptions) maxMessageLen() int {
+	if o == nil || o.MaxMessageLen == 0 {
+		return bgp.BGP_MAX_MESSAGE_LENGTH
+	}
+	return o.MaxMessageLen
+}
+
+func (o *PackOptions) maxUpdatesPerFlush() int {
+	if o == nil || o.MaxUpdatesPerFlush <= 0 {
+		return math.MaxInt32
+	}
+	return o.MaxUpdatesPerFlush
+}
+
+func (o *PackOptions) preferAggregation() bool {
+	return o == nil || o.PreferAggregation
+}
+
 type cage struct {
 	attrsBytes []byte
 	paths      []*Path
@@ -270,7 +559,7 @@ func newCage(b []byte, path *Path) *cage {
 
 type packerInterface interface {
 	add(*Path)
-	pack(options ...*bgp.MarshallingOption) []*bgp.BGPMessage
+	pack(popts *PackOptions, options ...*bgp.MarshallingOption) []*bgp.BGPMessage
 }
 
 type packer struct {
@@ -281,7 +570,7 @@ type packer struct {
 
 type packerMP struct {
 	packer
-	paths       []*Path
+	hashmap     map[uint32][]*cage
 	withdrawals []*Path
 }
 
@@ -298,7 +587,34 @@ func (p *packerMP) add(path *Path) {
 		return
 	}
 
-	p.paths = append(p.paths, path)
+	// MP_REACH_NLRI carries the nexthop, not a separate NEXT_HOP attribute,
+	// so fold it into the cage key alongside the other path attributes.
+	key := path.GetHash()
+	attrsB := bytes.NewBuffer(make([]byte, 0))
+	attrsB.WriteString(path.GetNexthop().String())
+	for _, v := range path.GetPathAttrs() {
+		if v.GetType() == bgp.BGP_ATTR_TYPE_MP_REACH_NLRI {
+			continue
+		}
+		b, _ := v.Serialize()
+		attrsB.Write(b)
+	}
+
+	if cages, y := p.hashmap[key]; y {
+		added := false
+		for _, c := range cages {
+			if bytes.Compare(c.attrsBytes, attrsB.Bytes()) == 0 {
+				c.paths = append(c.paths, path)
+				added = true
+				break
+			}
+		}
+		if !added {
+			p.hashmap[key] = append(p.hashmap[key], newCage(attrsB.Bytes(), path))
+		}
+	} else {
+		p.hashmap[key] = []*cage{newCage(attrsB.Bytes(), path)}
+	}
 }
 
 func createMPReachMessage(path *Path) *bgp.BGPMessage {
@@ -314,16 +630,90 @@ func createMPReachMessage(path *Path) *bgp.BGPMessage {
 	return bgp.NewBGPUpdateMessage(nil, attrs, nil)
 }
 
-func (p *packerMP) pack(options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
+func (p *packerMP) pack(popts *PackOptions, options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
 	msgs := make([]*bgp.BGPMessage, 0, p.packer.total)
 
-	for _, path := range p.withdrawals {
-		nlris := []bgp.AddrPrefixInterface{path.GetNlri()}
-		msgs = append(msgs, bgp.NewBGPUpdateMessage(nil, []bgp.PathAttributeInterface{bgp.NewPathAttributeMpUnreachNLRI(nlris)}, nil))
+	addpathLen := 0
+	if bgp.IsAddPathEnabled(false, p.packer.family, options) {
+		addpathLen = 4
+	}
+	maxPerMsg := popts.maxUpdatesPerFlush()
+	if !popts.preferAggregation() {
+		maxPerMsg = 1
+	}
+
+	// Unlike packerV4's fixed 5-byte IPv4 NLRI constant, the wire size of an
+	// MP_REACH/MP_UNREACH NLRI varies by AFI/SAFI (IPv6-UC, VPNv4/v6, EVPN,
+	// ...), so each AddrPrefixInterface is asked for its own encoded length;
+	// addpathLen accounts for the 4-byte Path Identifier ADD-PATH prepends
+	// to every NLRI, so several paths for the same prefix that differ only
+	// by PathIdentifier still spend their fair share of the budget.
+	split := func(max int, paths []*Path) ([]bgp.AddrPrefixInterface, []*Path) {
+		nlris := make([]bgp.AddrPrefixInterface, 0, len(paths))
+		size := 0
+		i := 0
+		for ; i < len(paths) && len(nlris) < maxPerMsg; i++ {
+			l := paths[i].GetNlri().Len() + addpathLen
+			if len(nlris) > 0 && size+l > max {
+				break
+			}
+			nlris = append(nlris, paths[i].GetNlri())
+			size += l
+		}
+		return nlris, paths[i:]
 	}
 
-	for _, path := range p.paths {
-		msgs = append(msgs, createMPReachMessage(path))
+	loop := func(max int, paths []*Path, cb func([]bgp.AddrPrefixInterface)) {
+		var nlris []bgp.AddrPrefixInterface
+		for {
+			nlris, paths = split(max, paths)
+			if len(nlris) == 0 {
+				break
+			}
+			cb(nlris)
+		}
+	}
+
+	// Header + Update (WithdrawnRoutesLen + TotalPathAttributeLen + other
+	// attrs + the MP_(UN)REACH attribute header itself), bounded by
+	// popts.maxMessageLen(). mpHeaderLen is measured off a throwaway
+	// single-NLRI attribute rather than hand-rolled from the RFC 4760
+	// layout, so it stays correct however the bgp package encodes it.
+	maxNLRIBytes := func(attrsLen, mpHeaderLen int) int {
+		return popts.maxMessageLen() - (19 + 2 + 2 + attrsLen + mpHeaderLen)
+	}
+
+	if len(p.withdrawals) > 0 {
+		first := p.withdrawals[0]
+		mpHeaderLen := bgp.NewPathAttributeMpUnreachNLRI([]bgp.AddrPrefixInterface{first.GetNlri()}).Len() - first.GetNlri().Len()
+		loop(maxNLRIBytes(0, mpHeaderLen), p.withdrawals, func(nlris []bgp.AddrPrefixInterface) {
+			msgs = append(msgs, bgp.NewBGPUpdateMessage(nil, []bgp.PathAttributeInterface{bgp.NewPathAttributeMpUnreachNLRI(nlris)}, nil))
+		})
+	}
+
+	for _, cages := range p.hashmap {
+		for _, c := range cages {
+			paths := c.paths
+			nexthop := paths[0].GetNexthop().String()
+
+			attrs := make([]bgp.PathAttributeInterface, 0, len(paths[0].GetPathAttrs()))
+			attrsLen := 0
+			for _, a := range paths[0].GetPathAttrs() {
+				if a.GetType() == bgp.BGP_ATTR_TYPE_MP_REACH_NLRI {
+					continue
+				}
+				attrs = append(attrs, a)
+				attrsLen += a.Len()
+			}
+
+			mpHeaderLen := bgp.NewPathAttributeMpReachNLRI(nexthop, []bgp.AddrPrefixInterface{paths[0].GetNlri()}).Len() - paths[0].GetNlri().Len()
+			loop(maxNLRIBytes(attrsLen, mpHeaderLen), paths, func(nlris []bgp.AddrPrefixInterface) {
+				full := make([]bgp.PathAttributeInterface, len(attrs), len(attrs)+1)
+				copy(full, attrs)
+				full = append(full, bgp.NewPathAttributeMpReachNLRI(nexthop, nlris))
+				msgs = append(msgs, bgp.NewBGPUpdateMessage(nil, full, nil))
+			})
+		}
 	}
 
 	if p.eof {
@@ -337,8 +727,8 @@ func newPackerMP(f bgp.RouteFamily) *packerMP {
 		packer: packer{
 			family: f,
 		},
+		hashmap:     make(map[uint32][]*cage),
 		withdrawals: make([]*Path, 0),
-		paths:       make([]*Path, 0),
 	}
 }
 
@@ -392,13 +782,20 @@ func (p *packerV4) add(path *Path) {
 	}
 }
 
-func (p *packerV4) pack(options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
+func (p *packerV4) pack(popts *PackOptions, options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
+	maxPerMsg := popts.maxUpdatesPerFlush()
+	if !popts.preferAggregation() {
+		maxPerMsg = 1
+	}
 	split := func(max int, paths []*Path) ([]*bgp.IPAddrPrefix, []*Path) {
-		nlris := make([]*bgp.IPAddrPrefix, 0, max)
-		i := 0
 		if max > len(paths) {
 			max = len(paths)
 		}
+		if max > maxPerMsg {
+			max = maxPerMsg
+		}
+		nlris := make([]*bgp.IPAddrPrefix, 0, max)
+		i := 0
 		for ; i < max; i++ {
 			nlris = append(nlris, paths[i].GetNlri().(*bgp.IPAddrPrefix))
 		}
@@ -412,7 +809,7 @@ func (p *packerV4) pack(options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
 	// TotalPathAttributeLen + attributes + maxlen of NLRI).
 	// the max size of NLRI is 5bytes (plus 4bytes with addpath enabled)
 	maxNLRIs := func(attrsLen int) int {
-		return (bgp.BGP_MAX_MESSAGE_LENGTH - (19 + 2 + 2 + attrsLen)) / (5 + addpathNLRILen)
+		return (popts.maxMessageLen() - (19 + 2 + 2 + attrsLen)) / (5 + addpathNLRILen)
 	}
 
 	loop := func(attrsLen int, paths []*Path, cb func([]*bgp.IPAddrPrefix)) {
@@ -479,7 +876,17 @@ func newPacker(f bgp.RouteFamily) packerInterface {
 	}
 }
 
+// CreateUpdateMsgFromPaths packs pathList into as few UPDATE messages as
+// BGP_MAX_MESSAGE_LENGTH allows, coalescing paths that share path attributes
+// (and, for MP families, nexthop) into one message via packerV4/packerMP.
 func CreateUpdateMsgFromPaths(pathList []*Path, options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
+	return CreateUpdateMsgFromPathsWithOptions(pathList, nil, options...)
+}
+
+// CreateUpdateMsgFromPathsWithOptions is CreateUpdateMsgFromPaths with a
+// PackOptions to override how paths are packed (see its doc); popts may be
+// nil, in which case it behaves exactly like CreateUpdateMsgFromPaths.
+func CreateUpdateMsgFromPathsWithOptions(pathList []*Path, popts *PackOptions, options ...*bgp.MarshallingOption) []*bgp.BGPMessage {
 	msgs := make([]*bgp.BGPMessage, 0, len(pathList))
 
 	m := make(map[bgp.RouteFamily]packerInterface)
@@ -492,7 +899,7 @@ func CreateUpdateMsgFromPaths(pathList []*Path, options ...*bgp.MarshallingOptio
 	}
 
 	for _, p := range m {
-		msgs = append(msgs, p.pack(options...)...)
+		msgs = append(msgs, p.pack(popts, options...)...)
 	}
 	return msgs
-}
\ No newline at end of file
+}
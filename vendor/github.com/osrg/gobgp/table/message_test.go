@@ -0,0 +1,201 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package table
+
+import (
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/packet/bgp"
+)
+
+// ipv6AddPathAttrs builds the shared, non-MP path attributes plus an
+// MP_REACH_NLRI for nlri/nexthop, matching what packerMP.add expects to find
+// on a Path for an MP family (see its BGP_ATTR_TYPE_MP_REACH_NLRI handling).
+func ipv6AddPathAttrs(nlri bgp.AddrPrefixInterface, nexthop string) []bgp.PathAttributeInterface {
+	aspath := bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{
+		bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, []uint32{65001, 65002}),
+	})
+	return []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(bgp.BGP_ORIGIN_ATTR_TYPE_IGP),
+		aspath,
+		bgp.NewPathAttributeMpReachNLRI(nexthop, []bgp.AddrPrefixInterface{nlri}),
+	}
+}
+
+// Test_CreateUpdateMsgFromPathsIPv6AddPath exercises the coalescing this
+// chunk added to packerMP: hundreds of paths for the same IPv6-UC prefix,
+// differing only by ADD-PATH PathIdentifier, must come out the other end of
+// CreateUpdateMsgFromPaths as a decodable stream carrying every NLRI.
+func Test_CreateUpdateMsgFromPathsIPv6AddPath(t *testing.T) {
+	const n = 300
+	const nexthop = "2001:db8::1"
+
+	opts := []*bgp.MarshallingOption{
+		{AddPath: map[bgp.RouteFamily]bgp.BGPAddPathMode{
+			bgp.RF_IPv6_UC: bgp.BGP_ADD_PATH_BOTH,
+		}},
+	}
+
+	paths := make([]*Path, 0, n)
+	for i := 0; i < n; i++ {
+		nlri := bgp.NewIPv6AddrPrefix(32, "2001:db8::")
+		nlri.SetPathIdentifier(uint32(i))
+		attrs := ipv6AddPathAttrs(nlri, nexthop)
+		paths = append(paths, NewPath(nil, nlri, false, attrs, time.Now(), false))
+	}
+
+	msgs := CreateUpdateMsgFromPaths(paths, opts...)
+	if len(msgs) == 0 {
+		t.Fatalf("CreateUpdateMsgFromPaths returned no messages for %d paths", n)
+	}
+
+	total := 0
+	for _, msg := range msgs {
+		data, err := msg.Serialize(opts...)
+		if err != nil {
+			t.Fatalf("Serialize failed: %s", err)
+		}
+
+		parsed, err := bgp.ParseBGPMessage(data, opts...)
+		if err != nil {
+			t.Fatalf("ParseBGPMessage failed to decode a packed UPDATE: %s", err)
+		}
+
+		update := parsed.Body.(*bgp.BGPUpdate)
+		for _, attr := range update.PathAttributes {
+			reach, ok := attr.(*bgp.PathAttributeMpReachNLRI)
+			if !ok {
+				continue
+			}
+			total += len(reach.Value)
+		}
+	}
+
+	if total != n {
+		t.Fatalf("got %d NLRIs across %d messages, want %d", total, len(msgs), n)
+	}
+}
+
+// Test_CreateUpdateMsgFromPathsIPv6AddPathMaxUpdatesPerFlush checks that
+// PackOptions.MaxUpdatesPerFlush caps how many paths packerMP folds into one
+// UPDATE, without dropping any path or producing an undecodable message.
+func Test_CreateUpdateMsgFromPathsIPv6AddPathMaxUpdatesPerFlush(t *testing.T) {
+	const n = 40
+	const perFlush = 7
+	const nexthop = "2001:db8::1"
+
+	opts := []*bgp.MarshallingOption{
+		{AddPath: map[bgp.RouteFamily]bgp.BGPAddPathMode{
+			bgp.RF_IPv6_UC: bgp.BGP_ADD_PATH_BOTH,
+		}},
+	}
+
+	paths := make([]*Path, 0, n)
+	for i := 0; i < n; i++ {
+		nlri := bgp.NewIPv6AddrPrefix(32, "2001:db8::")
+		nlri.SetPathIdentifier(uint32(i))
+		attrs := ipv6AddPathAttrs(nlri, nexthop)
+		paths = append(paths, NewPath(nil, nlri, false, attrs, time.Now(), false))
+	}
+
+	popts := &PackOptions{MaxUpdatesPerFlush: perFlush, PreferAggregation: true}
+	msgs := CreateUpdateMsgFromPathsWithOptions(paths, popts, opts...)
+
+	total := 0
+	for _, msg := range msgs {
+		data, err := msg.Serialize(opts...)
+		if err != nil {
+			t.Fatalf("Serialize failed: %s", err)
+		}
+		if _, err := bgp.ParseBGPMessage(data, opts...); err != nil {
+			t.Fatalf("ParseBGPMessage failed to decode a packed UPDATE: %s", err)
+		}
+
+		update := msg.Body.(*bgp.BGPUpdate)
+		for _, attr := range update.PathAttributes {
+			reach, ok := attr.(*bgp.PathAttributeMpReachNLRI)
+			if !ok {
+				continue
+			}
+			if len(reach.Value) > perFlush {
+				t.Fatalf("UPDATE carries %d NLRIs, want at most %d", len(reach.Value), perFlush)
+			}
+			total += len(reach.Value)
+		}
+	}
+
+	if total != n {
+		t.Fatalf("got %d NLRIs across %d messages, want %d", total, len(msgs), n)
+	}
+}
+
+// Test_CreateUpdateMsgFromPathsIPv6Withdraw checks the MP_UNREACH coalescing
+// side of the same change.
+func Test_CreateUpdateMsgFromPathsIPv6Withdraw(t *testing.T) {
+	const n = 300
+
+	paths := make([]*Path, 0, n)
+	for i := 0; i < n; i++ {
+		nlri := bgp.NewIPv6AddrPrefix(64, fmtIPv6Prefix(i))
+		attrs := ipv6AddPathAttrs(nlri, "2001:db8::1")
+		paths = append(paths, NewPath(nil, nlri, true, attrs, time.Now(), false))
+	}
+
+	msgs := CreateUpdateMsgFromPaths(paths)
+	if len(msgs) == 0 {
+		t.Fatalf("CreateUpdateMsgFromPaths returned no messages for %d withdrawals", n)
+	}
+
+	total := 0
+	for _, msg := range msgs {
+		data, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Serialize failed: %s", err)
+		}
+		parsed, err := bgp.ParseBGPMessage(data)
+		if err != nil {
+			t.Fatalf("ParseBGPMessage failed to decode a packed withdrawal: %s", err)
+		}
+
+		update := parsed.Body.(*bgp.BGPUpdate)
+		for _, attr := range update.PathAttributes {
+			unreach, ok := attr.(*bgp.PathAttributeMpUnreachNLRI)
+			if !ok {
+				continue
+			}
+			total += len(unreach.Value)
+		}
+	}
+
+	if total != n {
+		t.Fatalf("got %d withdrawn NLRIs across %d messages, want %d", total, len(msgs), n)
+	}
+}
+
+func fmtIPv6Prefix(i int) string {
+	return "2001:db8:" + hex4(i) + "::"
+}
+
+func hex4(i int) string {
+	const digits = "0123456789abcdef"
+	b := [4]byte{}
+	for j := 3; j >= 0; j-- {
+		b[j] = digits[i&0xf]
+		i >>= 4
+	}
+	return string(b[:])
+}